@@ -0,0 +1,373 @@
+package proxyctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Microsoft/hcsshim/hcn"
+)
+
+// Action specifies whether traffic matching an ACLPolicy is let through or dropped.
+type Action string
+
+// Allow lets matching traffic through. Block drops it.
+const (
+	Allow Action = "Allow"
+	Block Action = "Block"
+)
+
+// Direction specifies which side of the endpoint an ACLPolicy applies to.
+type Direction string
+
+// In matches inbound traffic. Out matches outbound traffic.
+const (
+	In  Direction = "In"
+	Out Direction = "Out"
+)
+
+// RuleType specifies where an ACLPolicy is evaluated.
+type RuleType string
+
+// Host rules are evaluated at the host vSwitch port; Switch rules are
+// evaluated at the endpoint's own switch port.
+const (
+	Host   RuleType = "Host"
+	Switch RuleType = "Switch"
+)
+
+// aclAnyProtocol is the value AddACLPolicy sends HNS in place of an unset
+// Protocol, to mean "match any protocol". It is deliberately outside the
+// 0-255 range of IANA protocol numbers Protocol can hold.
+const aclAnyProtocol = 256
+
+// PortRange is an inclusive range of ports, [Start, End]. A single port is
+// expressed by setting Start and End to the same value.
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
+// ACLPolicy describes a 5-tuple firewall rule applied directly to an HNS
+// endpoint, independently of Policy and LoadBalancer.
+// Sidecar proxy deployments typically pair this with Policy, to block
+// direct egress from the workload container and only permit traffic
+// through the proxy's loopback.
+//
+// Unlike Policy, ACLPolicy has no UserSID field: hcn.AclPolicySetting, which
+// backs it, carries no user-SID equivalent, so HNS ACL rules can only match
+// on the network 5-tuple, not on the originating process identity.
+type ACLPolicy struct {
+	// Whether matching traffic is allowed or blocked. (Required)
+	Action Action
+
+	// Whether this rule applies to inbound or outbound traffic. (Required)
+	Direction Direction
+
+	// Whether this rule is evaluated at the host vSwitch port or the
+	// endpoint's own switch port. Defaults to Switch if left blank. (Optional)
+	RuleType RuleType
+
+	// Only match traffic originating from these addresses. (Optional)
+	LocalAddresses []*net.IPNet
+
+	// Only match traffic destined to these addresses. (Optional)
+	RemoteAddresses []*net.IPNet
+
+	// Only match traffic originating from these ports. (Optional)
+	LocalPorts []PortRange
+
+	// Only match traffic destined to these ports. (Optional)
+	RemotePorts []PortRange
+
+	// Only match traffic using this protocol. Matches any protocol if left
+	// unset -- unlike Policy.Protocol, this does not default to TCP.
+	// (Optional)
+	Protocol Protocol
+
+	// The priority of this rule; lower values are evaluated first. (Optional)
+	Priority uint16
+}
+
+// AddACLPolicy adds a 5-tuple firewall rule to HNS. The hnsEndpointID refers
+// to the ID of the endpoint as defined by HNS. An error is returned if the
+// policy passed in argument is invalid, or if it could not be applied for
+// any reason.
+func AddACLPolicy(hnsEndpointID string, policy ACLPolicy) error {
+	if err := validateACLPolicy(policy); err != nil {
+		return err
+	}
+
+	if policy.RuleType == "" {
+		policy.RuleType = Switch
+	}
+
+	// Unlike the proxy driver, HNS ACL rules aren't limited to TCP: an unset
+	// Protocol should match any protocol, not default to TCP. HNS has no
+	// dedicated "any protocol" value, so it uses aclAnyProtocol, a sentinel
+	// outside the 0-255 IANA protocol-number range, to mean that.
+	wireProtocol := int(policy.Protocol)
+	if policy.Protocol == 0 {
+		wireProtocol = aclAnyProtocol
+	}
+
+	policySetting := hcn.AclPolicySetting{
+		Protocols:       strconv.Itoa(wireProtocol),
+		Action:          hcn.ActionType(policy.Action),
+		Direction:       hcn.DirectionType(policy.Direction),
+		RuleType:        hcn.RuleType(policy.RuleType),
+		LocalAddresses:  formatAddrs(policy.LocalAddresses),
+		RemoteAddresses: formatAddrs(policy.RemoteAddresses),
+		LocalPorts:      formatPorts(policy.LocalPorts),
+		RemotePorts:     formatPorts(policy.RemotePorts),
+		Priority:        policy.Priority,
+	}
+
+	policyJSON, err := json.Marshal(policySetting)
+	if err != nil {
+		return err
+	}
+
+	endpointPolicy := hcn.EndpointPolicy{
+		Type:     hcn.ACL,
+		Settings: policyJSON,
+	}
+
+	request := hcn.PolicyEndpointRequest{
+		Policies: []hcn.EndpointPolicy{endpointPolicy},
+	}
+
+	endpoint, err := hcn.GetEndpointByID(hnsEndpointID)
+	if err != nil {
+		return err
+	}
+
+	return endpoint.ApplyPolicy(hcn.RequestTypeAdd, request)
+}
+
+// ListACLPolicies returns the ACL policies that are currently active on the
+// given endpoint.
+func ListACLPolicies(hnsEndpointID string) ([]ACLPolicy, error) {
+	hcnPolicies, err := listACLPolicies(hnsEndpointID)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []ACLPolicy
+	for _, hcnPolicy := range hcnPolicies {
+		policy, err := hcnPolicyToACLPolicy(hcnPolicy)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+// ClearACLPolicies removes all the ACL policies from the specified
+// endpoint. It returns the number of policies that were removed, which will
+// be zero if an error occurred or if the endpoint did not have any active
+// ACL policies.
+func ClearACLPolicies(hnsEndpointID string) (numRemoved int, err error) {
+	policies, err := listACLPolicies(hnsEndpointID)
+	if err != nil {
+		return 0, err
+	}
+
+	policyReq := hcn.PolicyEndpointRequest{
+		Policies: policies,
+	}
+
+	policyJSON, err := json.Marshal(policyReq)
+	if err != nil {
+		return 0, err
+	}
+
+	modifyReq := &hcn.ModifyEndpointSettingRequest{
+		ResourceType: hcn.EndpointResourceTypePolicy,
+		RequestType:  hcn.RequestTypeRemove,
+		Settings:     policyJSON,
+	}
+
+	if err := hcn.ModifyEndpointSettings(hnsEndpointID, modifyReq); err != nil {
+		return 0, err
+	}
+	return len(policies), nil
+}
+
+// listACLPolicies returns the HCN *ACL* policies that are currently active
+// on the given endpoint.
+func listACLPolicies(hnsEndpointID string) ([]hcn.EndpointPolicy, error) {
+	endpoint, err := hcn.GetEndpointByID(hnsEndpointID)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []hcn.EndpointPolicy
+	for _, policy := range endpoint.Policies {
+		if policy.Type == hcn.ACL {
+			policies = append(policies, policy)
+		}
+	}
+
+	return policies, nil
+}
+
+// hcnPolicyToACLPolicy converts an ACL policy as defined by hcsshim to our
+// own API.
+func hcnPolicyToACLPolicy(hcnPolicy hcn.EndpointPolicy) (ACLPolicy, error) {
+	if hcnPolicy.Type != hcn.ACL {
+		panic("not an ACL policy")
+	}
+
+	var hcnPolicySetting hcn.AclPolicySetting
+	if err := json.Unmarshal(hcnPolicy.Settings, &hcnPolicySetting); err != nil {
+		return ACLPolicy{}, err
+	}
+
+	protocol, _ := strconv.Atoi(hcnPolicySetting.Protocols)
+	if protocol == aclAnyProtocol {
+		protocol = 0
+	}
+
+	localAddrs, err := parseAddrs(hcnPolicySetting.LocalAddresses)
+	if err != nil {
+		return ACLPolicy{}, err
+	}
+	remoteAddrs, err := parseAddrs(hcnPolicySetting.RemoteAddresses)
+	if err != nil {
+		return ACLPolicy{}, err
+	}
+
+	return ACLPolicy{
+		Action:          Action(hcnPolicySetting.Action),
+		Direction:       Direction(hcnPolicySetting.Direction),
+		RuleType:        RuleType(hcnPolicySetting.RuleType),
+		LocalAddresses:  localAddrs,
+		RemoteAddresses: remoteAddrs,
+		LocalPorts:      parsePorts(hcnPolicySetting.LocalPorts),
+		RemotePorts:     parsePorts(hcnPolicySetting.RemotePorts),
+		Protocol:        Protocol(protocol),
+		Priority:        hcnPolicySetting.Priority,
+	}, nil
+}
+
+// validateACLPolicy returns nil iff the provided policy is valid.
+func validateACLPolicy(policy ACLPolicy) error {
+	if policy.Action != Allow && policy.Action != Block {
+		return fmt.Errorf("ACL policy has invalid action %q", policy.Action)
+	}
+	if policy.Direction != In && policy.Direction != Out {
+		return fmt.Errorf("ACL policy has invalid direction %q", policy.Direction)
+	}
+	if policy.RuleType != "" && policy.RuleType != Host && policy.RuleType != Switch {
+		return fmt.Errorf("ACL policy has invalid rule type %q", policy.RuleType)
+	}
+	if err := validateAddrFamily(policy.LocalAddresses); err != nil {
+		return fmt.Errorf("local addresses: %w", err)
+	}
+	if err := validateAddrFamily(policy.RemoteAddresses); err != nil {
+		return fmt.Errorf("remote addresses: %w", err)
+	}
+	if err := validateAddrFamily(append(append([]*net.IPNet(nil), policy.LocalAddresses...), policy.RemoteAddresses...)); err != nil {
+		return fmt.Errorf("local and remote addresses: %w", err)
+	}
+	if err := validatePortRanges(policy.LocalPorts); err != nil {
+		return fmt.Errorf("local ports: %w", err)
+	}
+	if err := validatePortRanges(policy.RemotePorts); err != nil {
+		return fmt.Errorf("remote ports: %w", err)
+	}
+	return nil
+}
+
+// formatAddrs joins a list of CIDRs into the comma-separated string HNS expects.
+func formatAddrs(cidrs []*net.IPNet) string {
+	if len(cidrs) == 0 {
+		return ""
+	}
+
+	addrs := make([]string, len(cidrs))
+	for i, cidr := range cidrs {
+		addrs[i] = cidr.String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// parseAddrs splits the comma-separated address list HNS returns back into CIDRs.
+func parseAddrs(s string) ([]*net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var cidrs []*net.IPNet
+	for _, addr := range strings.Split(s, ",") {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", addr)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			addr = fmt.Sprintf("%s/%d", addr, bits)
+		}
+
+		_, cidr, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// formatPorts joins a list of port ranges into the comma-separated
+// string HNS expects, e.g. "80,443,8000-8999".
+func formatPorts(ranges []PortRange) string {
+	if len(ranges) == 0 {
+		return ""
+	}
+
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		if r.Start == r.End {
+			parts[i] = strconv.Itoa(int(r.Start))
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", r.Start, r.End)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// parsePorts splits the comma-separated port list HNS returns back
+// into port ranges. Malformed entries are skipped.
+func parsePorts(s string) []PortRange {
+	if s == "" {
+		return nil
+	}
+
+	var ranges []PortRange
+	for _, part := range strings.Split(s, ",") {
+		if start, end, ok := strings.Cut(part, "-"); ok {
+			startNum, err1 := strconv.ParseUint(start, 10, 16)
+			endNum, err2 := strconv.ParseUint(end, 10, 16)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			ranges = append(ranges, PortRange{Start: uint16(startNum), End: uint16(endNum)})
+		} else {
+			num, err := strconv.ParseUint(part, 10, 16)
+			if err != nil {
+				continue
+			}
+			ranges = append(ranges, PortRange{Start: uint16(num), End: uint16(num)})
+		}
+	}
+	return ranges
+}
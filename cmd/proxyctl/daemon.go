@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/sprt/proxyctl/daemon"
+)
+
+// Flags for the "daemon" command
+var (
+	daemonConfigPath  string
+	daemonMetricsAddr string
+)
+
+var cmdDaemon = &cobra.Command{
+	Use:   "daemon",
+	Short: "Reconcile proxy/ACL/load balancer policies from a declarative config file.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := daemon.LoadConfig(daemonConfigPath)
+		if err != nil {
+			errorOut(err)
+		}
+
+		d := daemon.New(*cfg)
+
+		go func() {
+			if err := daemon.ListenMetrics(daemonMetricsAddr, d.Metrics()); err != nil {
+				log.Printf("proxyctl: metrics server: %v", err)
+			}
+		}()
+
+		if err := d.Run(context.Background()); err != nil {
+			errorOut(err)
+		}
+	},
+}
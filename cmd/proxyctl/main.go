@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/spf13/cobra"
@@ -21,6 +24,10 @@ var (
 	compartmentID uint32
 	localAddr     net.IP
 	remoteAddr    net.IP
+	localCIDRs    []string
+	remoteCIDRs   []string
+	localPorts    []string
+	remotePorts   []string
 	priority      uint8
 	protocol      proxyctl.Protocol
 )
@@ -31,17 +38,38 @@ var cmdAdd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		endpointID := args[0]
+
+		localAddrs, err := parseCIDRs(localCIDRs)
+		if err != nil {
+			errorOut(err)
+		}
+		remoteAddrs, err := parseCIDRs(remoteCIDRs)
+		if err != nil {
+			errorOut(err)
+		}
+		localPortRanges, err := parsePortRanges(localPorts)
+		if err != nil {
+			errorOut(err)
+		}
+		remotePortRanges, err := parsePortRanges(remotePorts)
+		if err != nil {
+			errorOut(err)
+		}
+
 		policy := proxyctl.Policy{
 			ProxyPort:     proxyPort,
 			UserSID:       userSID,
 			CompartmentID: compartmentID,
 			LocalAddr:     localAddr,
 			RemoteAddr:    remoteAddr,
+			LocalAddrs:    localAddrs,
+			RemoteAddrs:   remoteAddrs,
+			LocalPorts:    localPortRanges,
+			RemotePorts:   remotePortRanges,
 			Priority:      priority,
 		}
 
-		err := proxyctl.AddPolicy(endpointID, policy)
-		if err != nil {
+		if err := proxyctl.AddPolicy(endpointID, policy); err != nil {
 			errorOut(err)
 		}
 
@@ -77,13 +105,22 @@ var cmdList = &cobra.Command{
 	},
 }
 
+// Flags for the "lookup" command
+var runtimeName string
+
 var cmdLookup = &cobra.Command{
-	Use:   "lookup <docker container ID>",
+	Use:   "lookup <container ID>",
 	Short: "Report the ID of the HNS endpoint to which the specified container is attached.",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		containerID := args[0]
-		hnsEndpointID, err := proxyctl.GetEndpointFromContainer(containerID)
+
+		runtime, err := proxyctl.NewContainerRuntime(runtimeName)
+		if err != nil {
+			errorOut(err)
+		}
+
+		hnsEndpointID, err := proxyctl.LookupEndpoint(context.Background(), runtime, containerID)
 		if err != nil {
 			errorOut(err)
 		}
@@ -91,11 +128,283 @@ var cmdLookup = &cobra.Command{
 	},
 }
 
+// Flags for the "lb add" command
+var (
+	lbVIPs         []net.IP
+	lbBackendIDs   []string
+	lbFrontendPort uint16
+	lbBackendPort  uint16
+	lbSourceVIP    net.IP
+	lbDSR          bool
+	lbILB          bool
+	lbPreserveDIP  bool
+)
+
+var cmdLB = &cobra.Command{
+	Use:   "lb",
+	Short: "Manage HNS load balancers.",
+}
+
+var cmdLBAdd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a load balancer.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		lb := proxyctl.LoadBalancer{
+			VIPs:               lbVIPs,
+			BackendEndpointIDs: lbBackendIDs,
+			FrontendPort:       lbFrontendPort,
+			BackendPort:        lbBackendPort,
+			SourceVIP:          lbSourceVIP,
+			DSR:                lbDSR,
+			ILB:                lbILB,
+			PreserveDIP:        lbPreserveDIP,
+		}
+
+		hnsLoadBalancerID, err := proxyctl.AddLoadBalancer(lb)
+		if err != nil {
+			errorOut(err)
+		}
+
+		fmt.Println("Successfully added the load balancer:", hnsLoadBalancerID)
+	},
+}
+
+var cmdLBList = &cobra.Command{
+	Use:   "list",
+	Short: "List the active HNS load balancers.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		loadBalancers, err := proxyctl.ListLoadBalancers()
+		if err != nil {
+			errorOut(err)
+		}
+		spew.Dump(loadBalancers)
+	},
+}
+
+var cmdLBRemove = &cobra.Command{
+	Use:   "remove <HNS load balancer ID>",
+	Short: "Remove a load balancer.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		hnsLoadBalancerID := args[0]
+		if err := proxyctl.RemoveLoadBalancer(hnsLoadBalancerID); err != nil {
+			errorOut(err)
+		}
+		fmt.Println("Removed the load balancer")
+	},
+}
+
+// Flags for the "healthcheck add" command
+var (
+	hcVIP    net.IP
+	hcPort   uint16
+	hcNodeIP net.IP
+)
+
+var cmdHealthCheck = &cobra.Command{
+	Use:   "healthcheck",
+	Short: "Manage health-check VIP forwards.",
+}
+
+var cmdHealthCheckAdd = &cobra.Command{
+	Use:   "add <HNS endpoint ID>",
+	Short: "Forward a service VIP's health-check port to this node.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		endpointID := args[0]
+		cfg := proxyctl.HealthCheckForward{
+			VIP:    hcVIP,
+			Port:   hcPort,
+			NodeIP: hcNodeIP,
+		}
+
+		hnsLoadBalancerID, err := proxyctl.AddHealthCheckForward(endpointID, cfg)
+		if err != nil {
+			errorOut(err)
+		}
+
+		fmt.Println("Successfully added the health check forward:", hnsLoadBalancerID)
+	},
+}
+
+var cmdHealthCheckClear = &cobra.Command{
+	Use:   "clear <HNS endpoint ID>",
+	Short: "Remove all health-check VIP forwards from an endpoint.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		endpointID := args[0]
+		numRemoved, err := proxyctl.ClearHealthCheckForwards(endpointID)
+		if err != nil {
+			errorOut(err)
+		}
+		fmt.Println("Removed", numRemoved, "health check forwards")
+	},
+}
+
+// Flags for the "acl add" command
+var (
+	aclAction      string
+	aclDirection   string
+	aclRuleType    string
+	aclLocalCIDRs  []string
+	aclRemoteCIDRs []string
+	aclLocalPorts  []string
+	aclRemotePorts []string
+	aclProtocol    uint8
+	aclPriority    uint16
+)
+
+var cmdACL = &cobra.Command{
+	Use:   "acl",
+	Short: "Manage HNS ACL (5-tuple firewall) policies.",
+}
+
+var cmdACLAdd = &cobra.Command{
+	Use:   "add <HNS endpoint ID>",
+	Short: "Add a 5-tuple firewall rule to an endpoint.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		endpointID := args[0]
+
+		localAddrs, err := parseCIDRs(aclLocalCIDRs)
+		if err != nil {
+			errorOut(err)
+		}
+		remoteAddrs, err := parseCIDRs(aclRemoteCIDRs)
+		if err != nil {
+			errorOut(err)
+		}
+		localPorts, err := parsePortRanges(aclLocalPorts)
+		if err != nil {
+			errorOut(err)
+		}
+		remotePorts, err := parsePortRanges(aclRemotePorts)
+		if err != nil {
+			errorOut(err)
+		}
+
+		policy := proxyctl.ACLPolicy{
+			Action:          proxyctl.Action(aclAction),
+			Direction:       proxyctl.Direction(aclDirection),
+			RuleType:        proxyctl.RuleType(aclRuleType),
+			LocalAddresses:  localAddrs,
+			RemoteAddresses: remoteAddrs,
+			LocalPorts:      localPorts,
+			RemotePorts:     remotePorts,
+			Protocol:        proxyctl.Protocol(aclProtocol),
+			Priority:        aclPriority,
+		}
+
+		if err := proxyctl.AddACLPolicy(endpointID, policy); err != nil {
+			errorOut(err)
+		}
+
+		fmt.Println("Successfully added the ACL policy")
+	},
+}
+
+var cmdACLList = &cobra.Command{
+	Use:   "list <HNS endpoint ID>",
+	Short: "List the active ACL policies on an endpoint.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		endpointID := args[0]
+		policies, err := proxyctl.ListACLPolicies(endpointID)
+		if err != nil {
+			errorOut(err)
+		}
+		spew.Dump(policies)
+	},
+}
+
+var cmdACLClear = &cobra.Command{
+	Use:   "clear <HNS endpoint ID>",
+	Short: "Remove all ACL policies from an endpoint.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		endpointID := args[0]
+		numRemoved, err := proxyctl.ClearACLPolicies(endpointID)
+		if err != nil {
+			errorOut(err)
+		}
+		fmt.Println("Removed", numRemoved, "ACL policies")
+	},
+}
+
+// parseCIDRs converts the values of a repeated --*-cidr flag into IPNets,
+// treating a bare IP address as a single-address CIDR.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			value = fmt.Sprintf("%s/%d", value, bits)
+		}
+
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// parsePortRanges converts the values of a repeated --*-ports flag (each
+// either a single port or a "start-end" range) into PortRanges.
+func parsePortRanges(values []string) ([]proxyctl.PortRange, error) {
+	var ranges []proxyctl.PortRange
+	for _, value := range values {
+		if start, end, ok := strings.Cut(value, "-"); ok {
+			startNum, err := strconv.ParseUint(start, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %w", value, err)
+			}
+			endNum, err := strconv.ParseUint(end, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %w", value, err)
+			}
+			ranges = append(ranges, proxyctl.PortRange{Start: uint16(startNum), End: uint16(endNum)})
+		} else {
+			num, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q: %w", value, err)
+			}
+			ranges = append(ranges, proxyctl.PortRange{Start: uint16(num), End: uint16(num)})
+		}
+	}
+	return ranges, nil
+}
+
 func init() {
 	rootCmd.AddCommand(cmdAdd)
 	rootCmd.AddCommand(cmdClear)
 	rootCmd.AddCommand(cmdList)
 	rootCmd.AddCommand(cmdLookup)
+	rootCmd.AddCommand(cmdLB)
+	rootCmd.AddCommand(cmdHealthCheck)
+	rootCmd.AddCommand(cmdACL)
+	rootCmd.AddCommand(cmdDaemon)
+
+	cmdLB.AddCommand(cmdLBAdd)
+	cmdLB.AddCommand(cmdLBList)
+	cmdLB.AddCommand(cmdLBRemove)
+
+	cmdHealthCheck.AddCommand(cmdHealthCheckAdd)
+	cmdHealthCheck.AddCommand(cmdHealthCheckClear)
+
+	cmdACL.AddCommand(cmdACLAdd)
+	cmdACL.AddCommand(cmdACLList)
+	cmdACL.AddCommand(cmdACLClear)
 }
 
 func main() {
@@ -106,8 +415,55 @@ func main() {
 	cmdAdd.Flags().Uint32Var(&compartmentID, "compartment", 0, "only proxy traffic originating from the specified network compartment")
 	cmdAdd.Flags().IPVar(&localAddr, "localaddr", nil, "only proxy traffic originating from the specified address")
 	cmdAdd.Flags().IPVar(&remoteAddr, "remoteaddr", nil, "only proxy traffic destinated to the specified address")
+	cmdAdd.Flags().StringArrayVar(&localCIDRs, "local-cidr", nil, "only proxy traffic originating from this address or CIDR (repeatable)")
+	cmdAdd.Flags().StringArrayVar(&remoteCIDRs, "remote-cidr", nil, "only proxy traffic destined to this address or CIDR (repeatable)")
+	cmdAdd.Flags().StringArrayVar(&localPorts, "local-ports", nil, "only proxy traffic originating from this port or port range (repeatable)")
+	cmdAdd.Flags().StringArrayVar(&remotePorts, "remote-ports", nil, "only proxy traffic destined to this port or port range (repeatable)")
 	cmdAdd.Flags().Uint8Var(&priority, "priority", 0, "the priority of this policy")
 
+	// Flags for the "lookup" command
+	cmdLookup.Flags().StringVar(&runtimeName, "runtime", proxyctl.DockerRuntimeName, "container runtime to resolve the container through (docker or containerd)")
+
+	// Flags for the "lb add" command
+	cmdLBAdd.Flags().IPSliceVar(&lbVIPs, "vip", nil, "VIP the load balancer accepts traffic on (repeatable)")
+	cmdLBAdd.MarkFlagRequired("vip")
+	cmdLBAdd.Flags().StringSliceVar(&lbBackendIDs, "backend", nil, "HNS endpoint ID of a backend (repeatable)")
+	cmdLBAdd.MarkFlagRequired("backend")
+	cmdLBAdd.Flags().Uint16Var(&lbFrontendPort, "frontend-port", 0, "port traffic arrives on")
+	cmdLBAdd.MarkFlagRequired("frontend-port")
+	cmdLBAdd.Flags().Uint16Var(&lbBackendPort, "backend-port", 0, "port traffic is forwarded to on the backends")
+	cmdLBAdd.MarkFlagRequired("backend-port")
+	cmdLBAdd.Flags().IPVar(&lbSourceVIP, "source-vip", nil, "rewrite the source address of forwarded traffic to this VIP")
+	cmdLBAdd.Flags().BoolVar(&lbDSR, "dsr", false, "enable Direct Server Return")
+	cmdLBAdd.Flags().BoolVar(&lbILB, "ilb", false, "mark this as an internal load balancer")
+	cmdLBAdd.Flags().BoolVar(&lbPreserveDIP, "preserve-dip", false, "preserve the original destination VIP on forwarded packets")
+
+	// Flags for the "healthcheck add" command
+	cmdHealthCheckAdd.Flags().IPVar(&hcVIP, "vip", nil, "service VIP health probes are addressed to")
+	cmdHealthCheckAdd.MarkFlagRequired("vip")
+	cmdHealthCheckAdd.Flags().Uint16Var(&hcPort, "port", 0, "health check port to forward")
+	cmdHealthCheckAdd.MarkFlagRequired("port")
+	cmdHealthCheckAdd.Flags().IPVar(&hcNodeIP, "node-ip", nil, "node IP health probes are forwarded to")
+	cmdHealthCheckAdd.MarkFlagRequired("node-ip")
+
+	// Flags for the "acl add" command
+	cmdACLAdd.Flags().StringVar(&aclAction, "action", "", "whether to allow or block matching traffic (Allow or Block)")
+	cmdACLAdd.MarkFlagRequired("action")
+	cmdACLAdd.Flags().StringVar(&aclDirection, "direction", "", "whether this rule applies to inbound or outbound traffic (In or Out)")
+	cmdACLAdd.MarkFlagRequired("direction")
+	cmdACLAdd.Flags().StringVar(&aclRuleType, "ruletype", "", "where this rule is evaluated (Host or Switch, defaults to Switch)")
+	cmdACLAdd.Flags().StringArrayVar(&aclLocalCIDRs, "local-cidr", nil, "only match traffic originating from this address or CIDR (repeatable)")
+	cmdACLAdd.Flags().StringArrayVar(&aclRemoteCIDRs, "remote-cidr", nil, "only match traffic destined to this address or CIDR (repeatable)")
+	cmdACLAdd.Flags().StringArrayVar(&aclLocalPorts, "local-ports", nil, "only match traffic originating from this port or port range (repeatable)")
+	cmdACLAdd.Flags().StringArrayVar(&aclRemotePorts, "remote-ports", nil, "only match traffic destined to this port or port range (repeatable)")
+	cmdACLAdd.Flags().Uint16Var(&aclPriority, "priority", 0, "the priority of this rule; lower values are evaluated first")
+	cmdACLAdd.Flags().Uint8Var(&aclProtocol, "protocol", 0, "only match traffic using this IANA protocol number; matches any protocol if left unset")
+
+	// Flags for the "daemon" command
+	cmdDaemon.Flags().StringVar(&daemonConfigPath, "config", "", "path to the declarative policies config file")
+	cmdDaemon.MarkFlagRequired("config")
+	cmdDaemon.Flags().StringVar(&daemonMetricsAddr, "metrics-addr", ":9100", "address to serve Prometheus metrics on")
+
 	rootCmd.Execute()
 }
 
@@ -0,0 +1,30 @@
+package daemon
+
+import "time"
+
+// backoff implements a simple exponential backoff with a cap, used to retry
+// a target's reconciliation after a transient HNS failure.
+type backoff struct {
+	cur time.Duration
+	min time.Duration
+	max time.Duration
+}
+
+func newBackoff() *backoff {
+	return &backoff{min: time.Second, max: 30 * time.Second}
+}
+
+// next returns the delay to wait before the next retry, doubling it from the
+// previous call and capping it at max.
+func (b *backoff) next() time.Duration {
+	switch {
+	case b.cur == 0:
+		b.cur = b.min
+	case b.cur < b.max:
+		b.cur *= 2
+		if b.cur > b.max {
+			b.cur = b.max
+		}
+	}
+	return b.cur
+}
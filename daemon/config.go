@@ -0,0 +1,115 @@
+// Package daemon implements a reconciliation loop that keeps proxy, ACL and
+// load balancer policies installed on HNS endpoints in sync with a
+// declarative configuration file.
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sprt/proxyctl"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the top-level shape of the YAML document passed to
+// `proxyctl daemon --config`. It lists the endpoints the daemon manages and
+// the policies that should be installed on each of them.
+type Config struct {
+	// ForwardHealthCheckVIP, if set, makes the daemon additionally install
+	// each target's HealthCheckForwards. It is off by default so that
+	// enabling health-check forwarding is an explicit opt-in.
+	ForwardHealthCheckVIP bool `yaml:"forwardHealthCheckVIP,omitempty"`
+
+	// Targets lists the endpoints to reconcile and their desired policies.
+	Targets []Target `yaml:"targets"`
+}
+
+// Target selects one HNS endpoint, by exactly one of ContainerID,
+// ContainerLabel or EndpointID, and lists the policies that should be
+// installed on it.
+type Target struct {
+	// The ID of the container whose endpoint should be reconciled. (Optional)
+	ContainerID string `yaml:"containerID,omitempty"`
+
+	// A "key=value" container label selecting the container whose endpoint
+	// should be reconciled. (Optional)
+	ContainerLabel string `yaml:"containerLabel,omitempty"`
+
+	// The ID of the HNS endpoint to reconcile directly. (Optional)
+	EndpointID string `yaml:"endpointID,omitempty"`
+
+	// The container runtime to resolve the container's endpoint through.
+	// Defaults to proxyctl.DockerRuntimeName. ContainerLabel itself is always
+	// looked up through the Docker API, whatever the runtime. (Optional)
+	Runtime string `yaml:"runtime,omitempty"`
+
+	// The proxy policies this target should have installed.
+	Policies []proxyctl.Policy `yaml:"policies,omitempty"`
+
+	// The ACL policies this target should have installed.
+	ACLPolicies []proxyctl.ACLPolicy `yaml:"aclPolicies,omitempty"`
+
+	// The load balancers this target should back.
+	LoadBalancers []proxyctl.LoadBalancer `yaml:"loadBalancers,omitempty"`
+
+	// The health-check VIP forwards this target should have installed.
+	// Only applied when Config.ForwardHealthCheckVIP is set.
+	HealthCheckForwards []proxyctl.HealthCheckForward `yaml:"healthCheckForwards,omitempty"`
+}
+
+// LoadConfig reads and parses the declarative configuration document at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// describe returns a short human-readable identifier for the target, for use
+// in logs.
+func (t Target) describe() string {
+	switch {
+	case t.ContainerID != "":
+		return fmt.Sprintf("container %s", t.ContainerID)
+	case t.ContainerLabel != "":
+		return fmt.Sprintf("container label %s", t.ContainerLabel)
+	default:
+		return fmt.Sprintf("endpoint %s", t.EndpointID)
+	}
+}
+
+func (cfg Config) validate() error {
+	for i, target := range cfg.Targets {
+		selectors := 0
+		if target.ContainerID != "" {
+			selectors++
+		}
+		if target.ContainerLabel != "" {
+			selectors++
+		}
+		if target.EndpointID != "" {
+			selectors++
+		}
+		if selectors != 1 {
+			return fmt.Errorf("target %d: exactly one of containerID, containerLabel or endpointID must be set", i)
+		}
+	}
+
+	if len(cfg.Targets) == 0 {
+		return errors.New("config has no targets")
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the Prometheus collectors a Daemon reports reconciliation
+// health through.
+type Metrics struct {
+	reconcileAttempts prometheus.Counter
+	reconcileErrors   prometheus.Counter
+	policyCount       *prometheus.GaugeVec
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		reconcileAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proxyctl",
+			Subsystem: "daemon",
+			Name:      "reconcile_attempts_total",
+			Help:      "Total number of target reconciliation attempts.",
+		}),
+		reconcileErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proxyctl",
+			Subsystem: "daemon",
+			Name:      "reconcile_errors_total",
+			Help:      "Total number of target reconciliation attempts that failed.",
+		}),
+		policyCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "proxyctl",
+			Subsystem: "daemon",
+			Name:      "policy_count",
+			Help:      "Number of policies currently desired, per endpoint and policy kind.",
+		}, []string{"endpoint_id", "kind"}),
+	}
+}
+
+// Register registers m's collectors with reg.
+func (m *Metrics) Register(reg *prometheus.Registry) {
+	reg.MustRegister(m.reconcileAttempts, m.reconcileErrors, m.policyCount)
+}
+
+// ListenMetrics registers m with a fresh Prometheus registry and serves it
+// over HTTP at addr (e.g. ":9100") under /metrics. It blocks until the
+// server fails.
+func ListenMetrics(addr string, m *Metrics) error {
+	reg := prometheus.NewRegistry()
+	m.Register(reg)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+
+	return http.ListenAndServe(addr, mux)
+}
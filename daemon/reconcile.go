@@ -0,0 +1,481 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/Microsoft/hcsshim/hcn"
+	"github.com/sprt/proxyctl"
+)
+
+// reconcileInterval is the fallback period reconcileAll runs on, in case an
+// endpoint create/delete notification from HNS is missed.
+const reconcileInterval = 30 * time.Second
+
+// Daemon reconciles the desired state described by a Config against the
+// actual policies installed on HNS endpoints.
+type Daemon struct {
+	cfg     Config
+	metrics *Metrics
+}
+
+// New returns a Daemon that reconciles cfg.
+func New(cfg Config) *Daemon {
+	return &Daemon{
+		cfg:     cfg,
+		metrics: newMetrics(),
+	}
+}
+
+// Metrics returns the Prometheus collectors this daemon reports reconcile
+// health through, for registration with an HTTP handler (see ListenMetrics).
+func (d *Daemon) Metrics() *Metrics {
+	return d.metrics
+}
+
+// Run reconciles the daemon's targets until ctx is canceled. It reconciles
+// once immediately, then again whenever HNS reports an endpoint create or
+// delete, and periodically as a fallback in case a notification was missed.
+func (d *Daemon) Run(ctx context.Context) error {
+	events, stopWatch, err := watchEndpoints()
+	if err != nil {
+		return fmt.Errorf("watching endpoints: %w", err)
+	}
+	defer stopWatch()
+
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	d.reconcileAll(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-events:
+			if !ok {
+				return errors.New("endpoint watch closed unexpectedly")
+			}
+			d.reconcileAll(ctx)
+		case <-ticker.C:
+			d.reconcileAll(ctx)
+		}
+	}
+}
+
+func (d *Daemon) reconcileAll(ctx context.Context) {
+	for _, target := range d.cfg.Targets {
+		d.reconcileTarget(ctx, target)
+	}
+}
+
+// maxReconcileAttempts bounds how many times reconcileTarget retries a
+// single target within one reconcile pass, so that a target which is
+// permanently failing (a container that never starts, a bad label) cannot
+// head-of-line-block reconciliation of the other targets forever. The next
+// tick or endpoint notification gives it another pass.
+const maxReconcileAttempts = 5
+
+// reconcileTarget reconciles a single target, retrying with exponential
+// backoff up to maxReconcileAttempts times, or until it converges or ctx is
+// canceled.
+func (d *Daemon) reconcileTarget(ctx context.Context, target Target) {
+	b := newBackoff()
+	for attempt := 1; attempt <= maxReconcileAttempts; attempt++ {
+		d.metrics.reconcileAttempts.Inc()
+
+		err := d.reconcileTargetOnce(ctx, target)
+		if err == nil {
+			return
+		}
+
+		d.metrics.reconcileErrors.Inc()
+		log.Printf("proxyctl: reconciling %s (attempt %d/%d): %v", target.describe(), attempt, maxReconcileAttempts, err)
+
+		if attempt == maxReconcileAttempts {
+			log.Printf("proxyctl: giving up on %s for this pass; will retry on the next reconcile", target.describe())
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.next()):
+		}
+	}
+}
+
+func (d *Daemon) reconcileTargetOnce(ctx context.Context, target Target) error {
+	endpointID, err := resolveEndpointID(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	if err := d.reconcilePolicies(endpointID, target.Policies); err != nil {
+		return err
+	}
+	if err := d.reconcileACLPolicies(endpointID, target.ACLPolicies); err != nil {
+		return err
+	}
+	if err := d.reconcileLoadBalancers(endpointID, target.LoadBalancers); err != nil {
+		return err
+	}
+	if d.cfg.ForwardHealthCheckVIP {
+		if err := d.reconcileHealthCheckForwards(endpointID, target.HealthCheckForwards); err != nil {
+			return err
+		}
+	}
+
+	d.metrics.policyCount.WithLabelValues(endpointID, "proxy").Set(float64(len(target.Policies)))
+	d.metrics.policyCount.WithLabelValues(endpointID, "acl").Set(float64(len(target.ACLPolicies)))
+	d.metrics.policyCount.WithLabelValues(endpointID, "loadbalancer").Set(float64(len(target.LoadBalancers)))
+
+	return nil
+}
+
+// reconcilePolicies converges the proxy policies installed on endpointID to
+// desired. Individual proxy policies cannot be removed from HNS one at a
+// time, so if any installed policy is no longer desired, every policy is
+// cleared and the desired set is reinstalled from scratch.
+//
+// Policies are compared by policyKey rather than by raw struct equality,
+// because AddPolicy/ListPolicies round-trip a policy through HNS and back:
+// the Protocol field gets defaulted to TCP and the deprecated scalar
+// LocalAddr/RemoteAddr fields get backfilled from LocalAddrs/RemoteAddrs, so
+// a desired policy never equals its own HNS readback verbatim.
+func (d *Daemon) reconcilePolicies(endpointID string, desired []proxyctl.Policy) error {
+	actual, err := proxyctl.ListPolicies(endpointID)
+	if err != nil {
+		return err
+	}
+
+	desiredKeys := make(map[string]bool, len(desired))
+	for _, policy := range desired {
+		desiredKeys[policyKey(policy)] = true
+	}
+
+	actualKeys := make(map[string]bool, len(actual))
+	stale := false
+	for _, policy := range actual {
+		key := policyKey(policy)
+		actualKeys[key] = true
+		if !desiredKeys[key] {
+			stale = true
+		}
+	}
+
+	if stale {
+		if _, err := proxyctl.ClearPolicies(endpointID); err != nil {
+			return err
+		}
+		actualKeys = nil
+	}
+
+	for _, policy := range desired {
+		if actualKeys[policyKey(policy)] {
+			continue
+		}
+		if err := proxyctl.AddPolicy(endpointID, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileACLPolicies converges the ACL policies installed on endpointID to
+// desired, the same all-or-nothing way reconcilePolicies does, comparing by
+// aclPolicyKey for the same reason reconcilePolicies uses policyKey.
+func (d *Daemon) reconcileACLPolicies(endpointID string, desired []proxyctl.ACLPolicy) error {
+	actual, err := proxyctl.ListACLPolicies(endpointID)
+	if err != nil {
+		return err
+	}
+
+	desiredKeys := make(map[string]bool, len(desired))
+	for _, policy := range desired {
+		desiredKeys[aclPolicyKey(policy)] = true
+	}
+
+	actualKeys := make(map[string]bool, len(actual))
+	stale := false
+	for _, policy := range actual {
+		key := aclPolicyKey(policy)
+		actualKeys[key] = true
+		if !desiredKeys[key] {
+			stale = true
+		}
+	}
+
+	if stale {
+		if _, err := proxyctl.ClearACLPolicies(endpointID); err != nil {
+			return err
+		}
+		actualKeys = nil
+	}
+
+	for _, policy := range desired {
+		if actualKeys[aclPolicyKey(policy)] {
+			continue
+		}
+		if err := proxyctl.AddACLPolicy(endpointID, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileLoadBalancers converges the load balancers backed by endpointID
+// to desired. Unlike proxy and ACL policies, load balancers carry their own
+// ID and can be removed individually, so only the minimum Add/Remove calls
+// needed to converge are issued.
+func (d *Daemon) reconcileLoadBalancers(endpointID string, desired []proxyctl.LoadBalancer) error {
+	all, err := hcn.ListLoadBalancers()
+	if err != nil {
+		return err
+	}
+
+	desiredKeys := make(map[string]bool, len(desired))
+	for _, lb := range desired {
+		desiredKeys[apiLoadBalancerKey(lb)] = true
+	}
+
+	matched := make(map[string]bool, len(desired))
+	for _, hnsLB := range all {
+		// Health-check VIP forwards are load balancers too (installed by
+		// reconcileHealthCheckForwards), so they must be skipped here the
+		// same way reconcileHealthCheckForwards skips ordinary ones --
+		// otherwise each reconcile pass would delete and recreate them.
+		if hnsLB.Flags&hcn.LoadBalancerFlagsLocalRoutedVIP != 0 {
+			continue
+		}
+		if !hasBackend(hnsLB, endpointID) {
+			continue
+		}
+
+		key := hnsLoadBalancerKey(hnsLB)
+		if desiredKeys[key] {
+			matched[key] = true
+			continue
+		}
+
+		if err := hnsLB.Delete(); err != nil {
+			return err
+		}
+	}
+
+	for _, lb := range desired {
+		if matched[apiLoadBalancerKey(lb)] {
+			continue
+		}
+		if _, err := proxyctl.AddLoadBalancer(lb); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reconcileHealthCheckForwards converges the health-check VIP forwards
+// installed on endpointID to desired. Like load balancers, forwards carry
+// their own ID and can be removed individually, so only the minimum
+// Add/Remove calls needed to converge are issued.
+func (d *Daemon) reconcileHealthCheckForwards(endpointID string, desired []proxyctl.HealthCheckForward) error {
+	all, err := hcn.ListLoadBalancers()
+	if err != nil {
+		return err
+	}
+
+	desiredKeys := make(map[string]bool, len(desired))
+	for _, fwd := range desired {
+		desiredKeys[apiHealthCheckForwardKey(fwd)] = true
+	}
+
+	matched := make(map[string]bool, len(desired))
+	for _, hnsLB := range all {
+		if hnsLB.Flags&hcn.LoadBalancerFlagsLocalRoutedVIP == 0 || !hasBackend(hnsLB, endpointID) {
+			continue
+		}
+
+		key := hnsHealthCheckForwardKey(hnsLB)
+		if desiredKeys[key] {
+			matched[key] = true
+			continue
+		}
+
+		if err := hnsLB.Delete(); err != nil {
+			return err
+		}
+	}
+
+	for _, fwd := range desired {
+		if matched[apiHealthCheckForwardKey(fwd)] {
+			continue
+		}
+		if _, err := proxyctl.AddHealthCheckForward(endpointID, fwd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasBackend reports whether hnsLB has endpointID among its backends.
+func hasBackend(hnsLB hcn.LoadBalancer, endpointID string) bool {
+	for _, id := range hnsLB.HostComputeEndpoints {
+		if id == endpointID {
+			return true
+		}
+	}
+	return false
+}
+
+// apiLoadBalancerKey and hnsLoadBalancerKey compute the same identity key
+// from, respectively, a desired proxyctl.LoadBalancer and the hcn.LoadBalancer
+// HNS reports, so that the two can be matched against each other without a
+// shared ID.
+
+func apiLoadBalancerKey(lb proxyctl.LoadBalancer) string {
+	vips := make([]string, len(lb.VIPs))
+	for i, ip := range lb.VIPs {
+		vips[i] = ip.String()
+	}
+	sort.Strings(vips)
+
+	backends := append([]string(nil), lb.BackendEndpointIDs...)
+	sort.Strings(backends)
+
+	// AddLoadBalancer defaults an unset Protocol to TCP, so the key must
+	// apply the same default or a desired LB never matches its HNS readback.
+	protocol := lb.Protocol
+	if protocol == 0 {
+		protocol = proxyctl.TCP
+	}
+
+	var sourceVIP string
+	if lb.SourceVIP != nil {
+		sourceVIP = lb.SourceVIP.String()
+	}
+
+	return fmt.Sprintf("vips=%v frontendPort=%d backendPort=%d backends=%v protocol=%d sourceVIP=%s dsr=%v ilb=%v preserveDIP=%v",
+		vips, lb.FrontendPort, lb.BackendPort, backends, protocol, sourceVIP, lb.DSR, lb.ILB, lb.PreserveDIP)
+}
+
+func hnsLoadBalancerKey(hnsLB hcn.LoadBalancer) string {
+	vips := append([]string(nil), hnsLB.FrontendVIPs...)
+	sort.Strings(vips)
+
+	backends := append([]string(nil), hnsLB.HostComputeEndpoints...)
+	sort.Strings(backends)
+
+	var frontendPort, backendPort uint16
+	var protocol uint32
+	var preserveDIP bool
+	if len(hnsLB.PortMappings) > 0 {
+		mapping := hnsLB.PortMappings[0]
+		frontendPort = mapping.ExternalPort
+		backendPort = mapping.InternalPort
+		protocol = mapping.Protocol
+		preserveDIP = mapping.Flags&hcn.LoadBalancerPortMappingFlagsPreserveDIP != 0
+	}
+
+	return fmt.Sprintf("vips=%v frontendPort=%d backendPort=%d backends=%v protocol=%d sourceVIP=%s dsr=%v ilb=%v preserveDIP=%v",
+		vips, frontendPort, backendPort, backends, protocol, hnsLB.SourceVIP,
+		hnsLB.Flags&hcn.LoadBalancerFlagsDSR != 0,
+		hnsLB.Flags&hcn.LoadBalancerFlagsILB != 0,
+		preserveDIP)
+}
+
+// apiHealthCheckForwardKey and hnsHealthCheckForwardKey compute the same
+// identity key from, respectively, a desired proxyctl.HealthCheckForward and
+// the hcn.LoadBalancer backing an installed forward, so the two can be
+// matched against each other without a shared ID.
+
+func apiHealthCheckForwardKey(fwd proxyctl.HealthCheckForward) string {
+	return fmt.Sprintf("vip=%s port=%d nodeIP=%s", fwd.VIP, fwd.Port, fwd.NodeIP)
+}
+
+func hnsHealthCheckForwardKey(hnsLB hcn.LoadBalancer) string {
+	var vip string
+	if len(hnsLB.FrontendVIPs) > 0 {
+		vip = hnsLB.FrontendVIPs[0]
+	}
+
+	var port uint16
+	if len(hnsLB.PortMappings) > 0 {
+		port = hnsLB.PortMappings[0].ExternalPort
+	}
+
+	return fmt.Sprintf("vip=%s port=%d nodeIP=%s", vip, port, hnsLB.SourceVIP)
+}
+
+// policyKey and aclPolicyKey compute a canonical identity key for a Policy
+// or ACLPolicy, normalizing away the representation differences between a
+// desired policy and its HNS readback (AddPolicy defaults Protocol to TCP,
+// AddACLPolicy defaults RuleType to Switch, and hcnPolicyToAPIPolicy
+// backfills the deprecated scalar LocalAddr/RemoteAddr fields from
+// LocalAddrs/RemoteAddrs), so the two compare equal when they describe the
+// same policy.
+
+func policyKey(p proxyctl.Policy) string {
+	protocol := p.Protocol
+	if protocol == 0 {
+		protocol = proxyctl.TCP
+	}
+
+	return fmt.Sprintf("port=%d userSID=%s compartment=%d local=%v remote=%v localPorts=%v remotePorts=%v priority=%d protocol=%d",
+		p.ProxyPort, p.UserSID, p.CompartmentID,
+		addrKeys(p.LocalAddr, p.LocalAddrs), addrKeys(p.RemoteAddr, p.RemoteAddrs),
+		portKeys(p.LocalPorts), portKeys(p.RemotePorts),
+		p.Priority, protocol)
+}
+
+func aclPolicyKey(p proxyctl.ACLPolicy) string {
+	// An unset ACL Protocol means "any protocol" and reads back as 0, so
+	// unlike policyKey it is not defaulted to TCP.
+	protocol := p.Protocol
+
+	ruleType := p.RuleType
+	if ruleType == "" {
+		ruleType = proxyctl.Switch
+	}
+
+	return fmt.Sprintf("action=%s direction=%s ruleType=%s local=%v remote=%v localPorts=%v remotePorts=%v priority=%d protocol=%d",
+		p.Action, p.Direction, ruleType,
+		addrKeys(nil, p.LocalAddresses), addrKeys(nil, p.RemoteAddresses),
+		portKeys(p.LocalPorts), portKeys(p.RemotePorts),
+		p.Priority, protocol)
+}
+
+// addrKeys returns the sorted string form of addrs, falling back to scalar
+// (the deprecated single-address field), as a /32 or /128 CIDR, as its sole
+// entry if addrs is empty.
+func addrKeys(scalar net.IP, addrs []*net.IPNet) []string {
+	keys := make([]string, 0, len(addrs)+1)
+	for _, addr := range addrs {
+		keys = append(keys, addr.String())
+	}
+	if len(keys) == 0 && scalar != nil {
+		bits := 32
+		if scalar.To4() == nil {
+			bits = 128
+		}
+		keys = append(keys, (&net.IPNet{IP: scalar, Mask: net.CIDRMask(bits, bits)}).String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// portKeys returns the sorted string form of ranges.
+func portKeys(ranges []proxyctl.PortRange) []string {
+	keys := make([]string, len(ranges))
+	for i, r := range ranges {
+		keys[i] = fmt.Sprintf("%d-%d", r.Start, r.End)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/sprt/proxyctl"
+)
+
+// resolveEndpointID resolves a Target to the ID of the HNS endpoint it
+// refers to, re-resolving the container-to-endpoint mapping on every call so
+// that container restarts (which get a new endpoint) are picked up.
+func resolveEndpointID(ctx context.Context, target Target) (string, error) {
+	if target.EndpointID != "" {
+		return target.EndpointID, nil
+	}
+
+	runtime, err := proxyctl.NewContainerRuntime(target.Runtime)
+	if err != nil {
+		return "", err
+	}
+
+	containerID := target.ContainerID
+	if containerID == "" {
+		containerID, err = resolveContainerByLabel(ctx, target.ContainerLabel)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return proxyctl.LookupEndpoint(ctx, runtime, containerID)
+}
+
+// resolveContainerByLabel returns the ID of the running container carrying
+// the "key=value" label.
+func resolveContainerByLabel(ctx context.Context, label string) (string, error) {
+	key, value, ok := strings.Cut(label, "=")
+	if !ok {
+		return "", fmt.Errorf("containerLabel %q must be in \"key=value\" form", label)
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return "", err
+	}
+
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", fmt.Sprintf("%s=%s", key, value))),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(containers) == 0 {
+		return "", fmt.Errorf("no running container found with label %q", label)
+	}
+
+	return containers[0].ID, nil
+}
@@ -0,0 +1,39 @@
+package daemon
+
+import "github.com/Microsoft/hcsshim/hcn"
+
+// endpointEvent signals that an HNS endpoint was created or deleted.
+type endpointEvent struct {
+	EndpointID string
+	Deleted    bool
+}
+
+// watchEndpoints subscribes to HNS endpoint create/delete notifications and
+// returns a channel of endpointEvents together with a function to stop
+// watching and release the underlying HNS callback.
+func watchEndpoints() (<-chan endpointEvent, func(), error) {
+	events := make(chan endpointEvent, 16)
+
+	callback := func(notificationType hcn.EndpointNotificationType, endpointID string, _ []byte) {
+		switch notificationType {
+		case hcn.EndpointNotificationTypeCreate, hcn.EndpointNotificationTypeDelete:
+			events <- endpointEvent{
+				EndpointID: endpointID,
+				Deleted:    notificationType == hcn.EndpointNotificationTypeDelete,
+			}
+		}
+	}
+
+	handle, err := hcn.RegisterEndpointNotification(callback)
+	if err != nil {
+		close(events)
+		return nil, nil, err
+	}
+
+	stop := func() {
+		hcn.UnregisterEndpointNotification(handle)
+		close(events)
+	}
+
+	return events, stop, nil
+}
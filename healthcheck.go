@@ -0,0 +1,109 @@
+package proxyctl
+
+import (
+	"errors"
+	"net"
+
+	"github.com/Microsoft/hcsshim/hcn"
+)
+
+// HealthCheckForward describes a health-check VIP forward: an HNS load
+// balancer that redirects traffic aimed at a service VIP's health-check
+// port to the node's own health-check endpoint. This lets an external
+// load balancer's health probes, which are addressed to the service VIP,
+// reach a health server bound to the node instead -- the situation
+// externalTrafficPolicy=Local deployments run into.
+type HealthCheckForward struct {
+	// The service VIP health probes are addressed to. (Required)
+	VIP net.IP
+
+	// The port health probes arrive on, and are forwarded to. (Required)
+	Port uint16
+
+	// The node's own IP, that health probes are forwarded to. (Required)
+	NodeIP net.IP
+}
+
+// AddHealthCheckForward installs an HNS load balancer that forwards
+// cfg.VIP:cfg.Port to cfg.NodeIP:cfg.Port, so that health probes addressed
+// to the service VIP reach the local health-check server instead of being
+// dropped. endpointID identifies the HNS endpoint the forward is installed
+// on; it is typically the node's own endpoint. It returns the ID HNS
+// assigned to the underlying load balancer.
+func AddHealthCheckForward(endpointID string, cfg HealthCheckForward) (hnsLoadBalancerID string, err error) {
+	if err := validateHealthCheckForward(cfg); err != nil {
+		return "", err
+	}
+
+	hnsLB := &hcn.LoadBalancer{
+		HostComputeEndpoints: []string{endpointID},
+		FrontendVIPs:         []string{cfg.VIP.String()},
+		SourceVIP:            cfg.NodeIP.String(),
+		Flags:                hcn.LoadBalancerFlagsLocalRoutedVIP,
+		PortMappings: []hcn.LoadBalancerPortMapping{
+			{
+				Protocol:     uint32(TCP),
+				InternalPort: cfg.Port,
+				ExternalPort: cfg.Port,
+				Flags:        hcn.LoadBalancerPortMappingFlagsPreserveDIP,
+			},
+		},
+	}
+
+	hnsLB, err = hnsLB.Create()
+	if err != nil {
+		return "", err
+	}
+
+	return hnsLB.Id, nil
+}
+
+// ClearHealthCheckForwards removes every health-check forward that
+// AddHealthCheckForward previously installed on the given endpoint. It
+// returns the number of forwards that were removed.
+func ClearHealthCheckForwards(endpointID string) (numRemoved int, err error) {
+	hnsLBs, err := hcn.ListLoadBalancers()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, hnsLB := range hnsLBs {
+		if !isHealthCheckForward(hnsLB, endpointID) {
+			continue
+		}
+		if err := hnsLB.Delete(); err != nil {
+			return numRemoved, err
+		}
+		numRemoved++
+	}
+
+	return numRemoved, nil
+}
+
+// isHealthCheckForward reports whether hnsLB is a health-check forward
+// AddHealthCheckForward installed on the given endpoint.
+func isHealthCheckForward(hnsLB hcn.LoadBalancer, endpointID string) bool {
+	if hnsLB.Flags&hcn.LoadBalancerFlagsLocalRoutedVIP == 0 {
+		return false
+	}
+	for _, id := range hnsLB.HostComputeEndpoints {
+		if id == endpointID {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHealthCheckForward returns nil iff the provided forward is valid.
+func validateHealthCheckForward(cfg HealthCheckForward) error {
+	if cfg.VIP == nil {
+		return errors.New("health check forward has no VIP")
+	}
+	if cfg.NodeIP == nil {
+		return errors.New("health check forward has no node IP")
+	}
+	if cfg.Port == 0 {
+		return errors.New("health check forward has invalid port number 0")
+	}
+	return nil
+}
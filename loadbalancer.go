@@ -0,0 +1,189 @@
+package proxyctl
+
+import (
+	"errors"
+	"net"
+
+	"github.com/Microsoft/hcsshim/hcn"
+)
+
+// LoadBalancer describes an HNS load balancer that distributes traffic
+// arriving on one or more VIPs across a set of backend endpoints. This is
+// a sibling of Policy: where Policy intercepts traffic into a sidecar proxy,
+// LoadBalancer steers traffic across a set of endpoints the way a Kubernetes
+// Service does.
+type LoadBalancer struct {
+	// The VIPs this load balancer accepts traffic on. (Required)
+	VIPs []net.IP
+
+	// IDs of the HNS endpoints traffic is distributed across. (Required)
+	BackendEndpointIDs []string
+
+	// The port traffic arrives on. (Required)
+	FrontendPort uint16
+
+	// The port traffic is forwarded to on the backend endpoints. (Required)
+	BackendPort uint16
+
+	// Only load-balance traffic using this protocol. Defaults to TCP if left
+	// blank. (Optional)
+	Protocol Protocol
+
+	// Rewrite the source address of forwarded traffic to this VIP, instead
+	// of the original client address. (Optional)
+	SourceVIP net.IP
+
+	// DSR enables Direct Server Return, so that replies bypass the load
+	// balancer and go straight back to the client. (Optional)
+	DSR bool
+
+	// ILB marks this as an internal load balancer rather than an external
+	// one. (Optional)
+	ILB bool
+
+	// PreserveDIP keeps the original destination VIP on forwarded packets,
+	// instead of rewriting it to the backend endpoint's address. (Optional)
+	PreserveDIP bool
+}
+
+// AddLoadBalancer adds a load balancer to HNS and returns the ID HNS assigned
+// to it. An error is returned if the load balancer passed in argument is
+// invalid, or if it could not be applied for any reason.
+func AddLoadBalancer(lb LoadBalancer) (hnsLoadBalancerID string, err error) {
+	if err := validateLoadBalancer(lb); err != nil {
+		return "", err
+	}
+
+	if lb.Protocol == 0 {
+		lb.Protocol = TCP
+	}
+
+	hnsLB := &hcn.LoadBalancer{
+		HostComputeEndpoints: lb.BackendEndpointIDs,
+		SourceVIP:            formatIP(lb.SourceVIP),
+		FrontendVIPs:         formatIPs(lb.VIPs),
+		Flags:                loadBalancerFlags(lb),
+		PortMappings: []hcn.LoadBalancerPortMapping{
+			{
+				Protocol:     uint32(lb.Protocol),
+				InternalPort: lb.BackendPort,
+				ExternalPort: lb.FrontendPort,
+				Flags:        loadBalancerPortMappingFlags(lb),
+			},
+		},
+	}
+
+	hnsLB, err = hnsLB.Create()
+	if err != nil {
+		return "", err
+	}
+
+	return hnsLB.Id, nil
+}
+
+// ListLoadBalancers returns the load balancers that are currently active in HNS.
+func ListLoadBalancers() ([]LoadBalancer, error) {
+	hnsLBs, err := hcn.ListLoadBalancers()
+	if err != nil {
+		return nil, err
+	}
+
+	var loadBalancers []LoadBalancer
+	for _, hnsLB := range hnsLBs {
+		loadBalancers = append(loadBalancers, hcnLoadBalancerToAPILoadBalancer(hnsLB))
+	}
+
+	return loadBalancers, nil
+}
+
+// RemoveLoadBalancer removes the load balancer identified by hnsLoadBalancerID
+// from HNS.
+func RemoveLoadBalancer(hnsLoadBalancerID string) error {
+	hnsLB, err := hcn.GetLoadBalancerByID(hnsLoadBalancerID)
+	if err != nil {
+		return err
+	}
+	return hnsLB.Delete()
+}
+
+// hcnLoadBalancerToAPILoadBalancer converts a load balancer as defined by
+// hcsshim to our own API.
+func hcnLoadBalancerToAPILoadBalancer(hnsLB hcn.LoadBalancer) LoadBalancer {
+	lb := LoadBalancer{
+		BackendEndpointIDs: hnsLB.HostComputeEndpoints,
+		SourceVIP:          net.ParseIP(hnsLB.SourceVIP),
+		DSR:                hnsLB.Flags&hcn.LoadBalancerFlagsDSR != 0,
+		ILB:                hnsLB.Flags&hcn.LoadBalancerFlagsILB != 0,
+	}
+
+	for _, vip := range hnsLB.FrontendVIPs {
+		lb.VIPs = append(lb.VIPs, net.ParseIP(vip))
+	}
+
+	if len(hnsLB.PortMappings) > 0 {
+		mapping := hnsLB.PortMappings[0]
+		lb.Protocol = Protocol(mapping.Protocol)
+		lb.BackendPort = mapping.InternalPort
+		lb.FrontendPort = mapping.ExternalPort
+		lb.PreserveDIP = mapping.Flags&hcn.LoadBalancerPortMappingFlagsPreserveDIP != 0
+	}
+
+	return lb
+}
+
+// validateLoadBalancer returns nil iff the provided load balancer is valid.
+func validateLoadBalancer(lb LoadBalancer) error {
+	if len(lb.VIPs) == 0 {
+		return errors.New("load balancer has no VIPs")
+	}
+	if len(lb.BackendEndpointIDs) == 0 {
+		return errors.New("load balancer has no backend endpoints")
+	}
+	if lb.FrontendPort == 0 {
+		return errors.New("load balancer has invalid frontend port number 0")
+	}
+	if lb.BackendPort == 0 {
+		return errors.New("load balancer has invalid backend port number 0")
+	}
+	return nil
+}
+
+// loadBalancerFlags translates the boolean toggles on LoadBalancer into the
+// hcn.LoadBalancerFlags bitmask HNS expects.
+func loadBalancerFlags(lb LoadBalancer) hcn.LoadBalancerFlags {
+	var flags hcn.LoadBalancerFlags
+	if lb.DSR {
+		flags |= hcn.LoadBalancerFlagsDSR
+	}
+	if lb.ILB {
+		flags |= hcn.LoadBalancerFlagsILB
+	}
+	return flags
+}
+
+// loadBalancerPortMappingFlags translates the boolean toggles on
+// LoadBalancer into the hcn.LoadBalancerPortMappingFlags bitmask HNS expects
+// for the port mapping.
+func loadBalancerPortMappingFlags(lb LoadBalancer) hcn.LoadBalancerPortMappingFlags {
+	var flags hcn.LoadBalancerPortMappingFlags
+	if lb.PreserveDIP {
+		flags |= hcn.LoadBalancerPortMappingFlagsPreserveDIP
+	}
+	return flags
+}
+
+// formatIPs returns the given addresses as strings, skipping nil entries.
+func formatIPs(ips []net.IP) []string {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		addrs = append(addrs, ip.String())
+	}
+	return addrs
+}
@@ -3,12 +3,12 @@
 package proxyctl
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
-	"os/exec"
+	"sort"
 	"strconv"
 
 	"github.com/Microsoft/hcsshim/hcn"
@@ -42,11 +42,31 @@ type Policy struct {
 	CompartmentID uint32
 
 	// Only proxy traffic originating from the specified address. (Optional)
+	//
+	// Deprecated: use LocalAddrs instead. If LocalAddrs is empty, LocalAddr
+	// is used as its sole entry.
 	LocalAddr net.IP
 
 	// Only proxy traffic destinated to the specified address. (Optional)
+	//
+	// Deprecated: use RemoteAddrs instead. If RemoteAddrs is empty,
+	// RemoteAddr is used as its sole entry.
 	RemoteAddr net.IP
 
+	// Only proxy traffic originating from these addresses or CIDRs. Both
+	// IPv4 and IPv6 are supported, but a single tuple cannot mix the two. (Optional)
+	LocalAddrs []*net.IPNet
+
+	// Only proxy traffic destined to these addresses or CIDRs. Both IPv4 and
+	// IPv6 are supported, but a single tuple cannot mix the two. (Optional)
+	RemoteAddrs []*net.IPNet
+
+	// Only proxy traffic originating from these ports. (Optional)
+	LocalPorts []PortRange
+
+	// Only proxy traffic destined to these ports. (Optional)
+	RemotePorts []PortRange
+
 	// The priority of this policy. (Optional)
 	// For more info, see https://docs.microsoft.com/en-us/windows/win32/fwp/filter-weight-assignment.
 	Priority uint8
@@ -74,8 +94,10 @@ func AddPolicy(hnsEndpointID string, policy Policy) error {
 		UserSID:       policy.UserSID,
 		CompartmentID: policy.CompartmentID,
 		FilterTuple: hcn.FiveTuple{
-			LocalAddresses:  formatIP(policy.LocalAddr),
-			RemoteAddresses: formatIP(policy.RemoteAddr),
+			LocalAddresses:  formatAddrs(mergeAddrs(policy.LocalAddr, policy.LocalAddrs)),
+			RemoteAddresses: formatAddrs(mergeAddrs(policy.RemoteAddr, policy.RemoteAddrs)),
+			LocalPorts:      formatPorts(policy.LocalPorts),
+			RemotePorts:     formatPorts(policy.RemotePorts),
 			Protocols:       strconv.Itoa(int(policy.Protocol)),
 			Priority:        uint16(policy.Priority),
 		},
@@ -151,65 +173,11 @@ func ClearPolicies(hnsEndpointID string) (numRemoved int, err error) {
 // the specified container is not attached to any endpoint. Note that there is
 // no verification done regarding whether the ID passed as argument belongs
 // to an actual container.
+//
+// Deprecated: use LookupEndpoint with a DockerRuntime (or ContainerdRuntime,
+// on nodes that no longer ship Docker) instead.
 func GetEndpointFromContainer(containerID string) (hnsEndpointID string, err error) {
-	// XXX: If possible, a better way to do this would be to patch hcsshim
-	// so that the endpoints it returns contain the SharedContainers field.
-
-	// Call hnsdiag to get a list of endpoints and the containers they're attached to.
-
-	var hnsOut bytes.Buffer
-	hnsCmd := exec.Command("hnsdiag", "list", "endpoints", "-df")
-	hnsCmd.Stdout = &hnsOut
-	if err = hnsCmd.Run(); err != nil {
-		return
-	}
-
-	// hnsdiag doesn't return a proper JSON list, instead it's a bunch of
-	// objects concatenated to each other, so we have to implement our own
-	// parsing logic to split those up. We assume that at least the separate
-	// endpoint objects are well-formed.
-
-	scanner := bufio.NewScanner(&hnsOut)
-
-	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		endOfEndpoint := []byte("\n}")
-		if atEOF && len(data) == 0 {
-			// No more data.
-			return
-		} else if i := bytes.Index(data, endOfEndpoint); i != -1 {
-			// '}' right after a newline indicates the end of an endpoint object.
-			// We thus advance the scanner past that character and return
-			// everything before as a new token.
-			advance = i + len(endOfEndpoint) + 1
-			return advance, data[:advance], nil
-		} else {
-			// Request more data.
-			return
-		}
-	})
-
-	for scanner.Scan() {
-		type hnsEndpoint struct {
-			ID               string
-			SharedContainers []string
-		}
-
-		var endpoint hnsEndpoint
-		err = json.Unmarshal(scanner.Bytes(), &endpoint)
-		if err != nil {
-			// Assuming HNS returns well-formed JSON objects,
-			// if an error happened it was our fault so let's panic.
-			panic(err)
-		}
-
-		for _, attachedID := range endpoint.SharedContainers {
-			if attachedID == containerID {
-				return endpoint.ID, nil
-			}
-		}
-	}
-
-	return "", errors.New("could not find an endpoint attached to that container")
+	return LookupEndpoint(context.Background(), DockerRuntime{}, containerID)
 }
 
 // listPolicies returns the HCN *proxy* policies that are currently active on the
@@ -245,28 +213,121 @@ func hcnPolicyToAPIPolicy(hcnPolicy hcn.EndpointPolicy) Policy {
 	port, _ := strconv.Atoi(hcnPolicySetting.Port)
 	protocol, _ := strconv.Atoi(hcnPolicySetting.FilterTuple.Protocols)
 
-	return Policy{
+	// Assuming HNS will never return invalid values from here.
+	localAddrs, _ := parseAddrs(hcnPolicySetting.FilterTuple.LocalAddresses)
+	remoteAddrs, _ := parseAddrs(hcnPolicySetting.FilterTuple.RemoteAddresses)
+
+	policy := Policy{
 		ProxyPort:     uint16(port),
 		UserSID:       hcnPolicySetting.UserSID,
 		CompartmentID: hcnPolicySetting.CompartmentID,
-		LocalAddr:     net.ParseIP(hcnPolicySetting.FilterTuple.LocalAddresses),
-		RemoteAddr:    net.ParseIP(hcnPolicySetting.FilterTuple.RemoteAddresses),
+		LocalAddrs:    localAddrs,
+		RemoteAddrs:   remoteAddrs,
+		LocalPorts:    parsePorts(hcnPolicySetting.FilterTuple.LocalPorts),
+		RemotePorts:   parsePorts(hcnPolicySetting.FilterTuple.RemotePorts),
 		Priority:      uint8(hcnPolicySetting.FilterTuple.Priority),
 		Protocol:      Protocol(protocol),
 	}
+
+	// Populate the deprecated scalar fields for callers that still read them.
+	if len(localAddrs) > 0 {
+		policy.LocalAddr = localAddrs[0].IP
+	}
+	if len(remoteAddrs) > 0 {
+		policy.RemoteAddr = remoteAddrs[0].IP
+	}
+
+	return policy
 }
 
 // validatePolicy returns nil iff the provided policy is valid.
-// For now it only checks that the port number is nonzero.
 func validatePolicy(policy Policy) error {
 	if policy.ProxyPort == 0 {
 		return errors.New("policy has invalid proxy port number 0")
 	}
+
+	localAddrs := mergeAddrs(policy.LocalAddr, policy.LocalAddrs)
+	remoteAddrs := mergeAddrs(policy.RemoteAddr, policy.RemoteAddrs)
+	if err := validateAddrFamily(localAddrs); err != nil {
+		return fmt.Errorf("local addresses: %w", err)
+	}
+	if err := validateAddrFamily(remoteAddrs); err != nil {
+		return fmt.Errorf("remote addresses: %w", err)
+	}
+	if err := validateAddrFamily(append(append([]*net.IPNet(nil), localAddrs...), remoteAddrs...)); err != nil {
+		return fmt.Errorf("local and remote addresses: %w", err)
+	}
+	if err := validatePortRanges(policy.LocalPorts); err != nil {
+		return fmt.Errorf("local ports: %w", err)
+	}
+	if err := validatePortRanges(policy.RemotePorts); err != nil {
+		return fmt.Errorf("remote ports: %w", err)
+	}
+
+	return nil
+}
+
+// mergeAddrs returns addrs if non-empty, or else a single-address CIDR
+// derived from scalar (the deprecated LocalAddr/RemoteAddr fields), or nil
+// if neither is set.
+func mergeAddrs(scalar net.IP, addrs []*net.IPNet) []*net.IPNet {
+	if len(addrs) > 0 {
+		return addrs
+	}
+	if cidr := hostCIDR(scalar); cidr != nil {
+		return []*net.IPNet{cidr}
+	}
+	return nil
+}
+
+// hostCIDR returns the /32 (or /128 for IPv6) CIDR matching ip exactly, or
+// nil if ip is nil.
+func hostCIDR(ip net.IP) *net.IPNet {
+	if ip == nil {
+		return nil
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+// validateAddrFamily returns an error if addrs mixes IPv4 and IPv6 entries.
+func validateAddrFamily(addrs []*net.IPNet) error {
+	if len(addrs) < 2 {
+		return nil
+	}
+
+	isV4 := addrs[0].IP.To4() != nil
+	for _, addr := range addrs[1:] {
+		if (addr.IP.To4() != nil) != isV4 {
+			return errors.New("mixed IPv4 and IPv6 addresses are not allowed in the same tuple")
+		}
+	}
+	return nil
+}
+
+// validatePortRanges returns an error if ranges contains an inverted or
+// overlapping range.
+func validatePortRanges(ranges []PortRange) error {
+	sorted := append([]PortRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	for i, r := range sorted {
+		if r.Start > r.End {
+			return fmt.Errorf("invalid port range %d-%d", r.Start, r.End)
+		}
+		if i > 0 && r.Start <= sorted[i-1].End {
+			return fmt.Errorf("overlapping port ranges %d-%d and %d-%d", sorted[i-1].Start, sorted[i-1].End, r.Start, r.End)
+		}
+	}
 	return nil
 }
 
-// formatIP returns the given address as a string,
-// or the empty string if it's nil.
+// formatIP returns the given address as a string, or the empty string if
+// it's nil. Unlike formatAddrs, this is for settings that take a single
+// plain address rather than a comma-separated list of CIDRs.
 func formatIP(ip net.IP) string {
 	if ip == nil {
 		return ""
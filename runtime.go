@@ -0,0 +1,121 @@
+package proxyctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Microsoft/hcsshim"
+	"github.com/Microsoft/hcsshim/hcn"
+	"github.com/containerd/containerd"
+)
+
+// Names accepted by NewContainerRuntime and the CLI's --runtime flag.
+const (
+	DockerRuntimeName     = "docker"
+	ContainerdRuntimeName = "containerd"
+)
+
+// ContainerRuntime abstracts over the container engine running on the node,
+// letting LookupEndpoint resolve a container ID to the HNS endpoint it is
+// attached to regardless of whether the node runs Docker or containerd.
+type ContainerRuntime interface {
+	// EndpointID returns the ID of the HNS endpoint attached to the
+	// container identified by containerID.
+	EndpointID(ctx context.Context, containerID string) (string, error)
+}
+
+// NewContainerRuntime returns the ContainerRuntime implementation named by
+// runtime ("docker" or "containerd"; "" defaults to "docker"). It returns an
+// error if the name is not recognized, or if the runtime could not be
+// reached.
+func NewContainerRuntime(runtime string) (ContainerRuntime, error) {
+	switch runtime {
+	case DockerRuntimeName, "":
+		return DockerRuntime{}, nil
+	case ContainerdRuntimeName:
+		return NewContainerdRuntime()
+	default:
+		return nil, fmt.Errorf("unknown container runtime %q", runtime)
+	}
+}
+
+// DockerRuntime resolves containers managed by Docker. It relies on HNS
+// recording Docker-attached containers in each endpoint's SharedContainers
+// field, which is only populated in the HNSv1 API (hcn's
+// HostComputeEndpoint has no equivalent field).
+type DockerRuntime struct{}
+
+// EndpointID implements ContainerRuntime.
+func (DockerRuntime) EndpointID(ctx context.Context, containerID string) (string, error) {
+	endpoints, err := hcsshim.HNSListEndpointRequest()
+	if err != nil {
+		return "", err
+	}
+
+	for _, endpoint := range endpoints {
+		for _, attachedID := range endpoint.SharedContainers {
+			if attachedID == containerID {
+				return endpoint.Id, nil
+			}
+		}
+	}
+
+	return "", errors.New("could not find an endpoint attached to that container")
+}
+
+// ContainerdRuntime resolves containers managed directly by containerd,
+// which does not populate SharedContainers. It instead resolves the
+// container's network namespace from its OCI spec and looks up the endpoint
+// attached to that namespace.
+type ContainerdRuntime struct {
+	client *containerd.Client
+}
+
+// containerdAddress is the default named pipe containerd listens on on
+// Windows nodes.
+const containerdAddress = `\\.\pipe\containerd-containerd`
+
+// NewContainerdRuntime connects to the local containerd daemon.
+func NewContainerdRuntime() (ContainerdRuntime, error) {
+	client, err := containerd.New(containerdAddress)
+	if err != nil {
+		return ContainerdRuntime{}, err
+	}
+	return ContainerdRuntime{client: client}, nil
+}
+
+// EndpointID implements ContainerRuntime.
+func (r ContainerdRuntime) EndpointID(ctx context.Context, containerID string) (string, error) {
+	container, err := r.client.LoadContainer(ctx, containerID)
+	if err != nil {
+		return "", err
+	}
+
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		return "", err
+	}
+	if spec.Windows == nil || spec.Windows.Network == nil || spec.Windows.Network.NetworkNamespace == "" {
+		return "", fmt.Errorf("container %q has no network namespace", containerID)
+	}
+
+	endpointIDs, err := hcn.GetNamespaceEndpointIds(spec.Windows.Network.NetworkNamespace)
+	if err != nil {
+		return "", err
+	}
+	if len(endpointIDs) == 0 {
+		return "", errors.New("could not find an endpoint attached to that container")
+	}
+
+	return endpointIDs[0], nil
+}
+
+// LookupEndpoint returns the ID of the HNS endpoint to which the container
+// identified by containerID is attached, resolving it through the given
+// ContainerRuntime. It returns an error if the specified container is not
+// attached to any endpoint. Note that there is no verification done
+// regarding whether the ID passed as argument belongs to an actual container.
+func LookupEndpoint(ctx context.Context, runtime ContainerRuntime, containerID string) (hnsEndpointID string, err error) {
+	return runtime.EndpointID(ctx, containerID)
+}